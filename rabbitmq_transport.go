@@ -1,81 +1,126 @@
 package servicebus
 
 import (
+	"context"
 	"errors"
 	"github.com/streadway/amqp"
 	"log"
+	"sync"
+	"time"
 )
 
-// RabbitMQClient - клієнт для роботи з RabbitMQ
-type RabbitMQClient struct {
-	Connection *amqp.Connection
-	Channel    *amqp.Channel
-	Exchange   string
-	Queue      string
-	Serializer *JSONSerializer
+// ExchangeKind - тип AMQP exchange
+type ExchangeKind string
+
+const (
+	ExchangeDirect  ExchangeKind = "direct"
+	ExchangeTopic   ExchangeKind = "topic"
+	ExchangeFanout  ExchangeKind = "fanout"
+	ExchangeHeaders ExchangeKind = "headers"
+)
+
+// Binding - опис прив'язки черги до exchange
+//
+// RoutingKey використовується для exchange типів direct/topic/fanout,
+// Arguments - для exchange типу headers (amqp.Table з умовами відповідності).
+type Binding struct {
+	RoutingKey string
+	Arguments  amqp.Table
 }
 
-// NewRabbitMQClient - створює нового клієнта RabbitMQ
-func NewRabbitMQClient(amqpURL, exchange, queue string) (*RabbitMQClient, error) {
-	log.Println("Initializing RabbitMQ connection...")
+// Option - функціональна опція для налаштування RabbitMQClient перед підключенням
+type Option func(*RabbitMQClient)
 
-	conn, err := amqp.Dial(amqpURL)
-	if err != nil {
-		log.Printf("Failed to connect to RabbitMQ: %v\n", err)
-		return nil, err
+// WithExchangeKind - задає тип exchange (за замовчуванням "direct")
+func WithExchangeKind(kind ExchangeKind) Option {
+	return func(client *RabbitMQClient) {
+		client.ExchangeKind = kind
 	}
+}
 
-	log.Println("Connection to RabbitMQ established successfully.")
-
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Printf("Failed to open a channel: %v\n", err)
-		conn.Close()
-		return nil, err
+// WithBindings - додає одну чи декілька прив'язок черги до exchange,
+// що будуть створені під час ініціалізації клієнта
+func WithBindings(bindings ...Binding) Option {
+	return func(client *RabbitMQClient) {
+		client.Bindings = append(client.Bindings, bindings...)
 	}
-	log.Println("Channel opened successfully.")
+}
 
-	serializer := &JSONSerializer{}
+// RabbitMQClient - клієнт для роботи з RabbitMQ
+//
+// Connection і Channel завжди відображають останню встановлену сесію, але для
+// операцій, що мають залишатись справними під час перепідключення (Send,
+// Consume), слід користуватись internal sessionBox, а не цими полями напряму.
+type RabbitMQClient struct {
+	Connection   *amqp.Connection
+	Channel      *amqp.Channel
+	Exchange     string
+	ExchangeKind ExchangeKind
+	Queue        string
+	Bindings     []Binding
+	Serializer   Serializer
+
+	mu                 sync.RWMutex
+	ctx                context.Context
+	cancel             context.CancelFunc
+	sessionBox         *sessionBox
+	sendTimeout        time.Duration
+	consumers          []consumerRegistration
+	reconnectListeners []chan error
+	serializers        serializerRegistry
+	workerPools        []*workerPool
+
+	reliable   bool
+	reliableMu sync.Mutex
+	prefetch   int
+	mandatory  bool
+	onReturn   func(amqp.Return)
+	deadLetter *DeadLetterConfig
+}
+
+// NewRabbitMQClient - створює нового клієнта RabbitMQ і запускає фонову петлю
+// перепідключення, яка переживає розриви з'єднання з брокером
+func NewRabbitMQClient(amqpURL, exchange, queue string, opts ...Option) (*RabbitMQClient, error) {
+	log.Println("Initializing RabbitMQ connection...")
+
+	jsonSerializer := &JSONSerializer{}
 
 	client := &RabbitMQClient{
-		Connection: conn,
-		Channel:    ch,
-		Exchange:   exchange,
-		Queue:      queue,
-		Serializer: serializer,
+		Exchange:     exchange,
+		ExchangeKind: ExchangeDirect,
+		Queue:        queue,
+		Serializer:   jsonSerializer,
+		sessionBox:   newSessionBox(),
+		sendTimeout:  defaultSendTimeout,
+		serializers:  newSerializerRegistry(jsonSerializer, &ProtobufSerializer{}, &MsgpackSerializer{}),
 	}
 
-	if err := client.createExchange(); err != nil {
-		log.Printf("Failed to create exchange: %v\n", err)
-		client.closeChanelConnection()
-		return nil, err
+	for _, opt := range opts {
+		opt(client)
 	}
 
-	if err := client.createQueue(); err != nil {
-		log.Printf("Failed to create queue: %v\n", err)
-		client.closeChanelConnection()
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+
+	session, err := client.dialSession(amqpURL)
+	if err != nil {
+		log.Printf("Failed to establish initial RabbitMQ session: %v\n", err)
+		client.cancel()
 		return nil, err
 	}
 
+	client.startRedial(client.ctx, amqpURL, session)
+
 	log.Println("RabbitMQ setup completed successfully.")
 	return client, nil
 }
 
-// closeChanelConnection - закриває канал і з'єднання
-func (client *RabbitMQClient) closeChanelConnection() {
-	log.Println("Closing RabbitMQ channel and connection...")
-	client.Channel.Close()
-	client.Connection.Close()
-	log.Println("RabbitMQ channel and connection closed.")
-}
-
 // createExchange - створює exchange, якщо це необхідно
 func (client *RabbitMQClient) createExchange() error {
 	if client.Exchange != "" {
-		log.Printf("Creating exchange: %s\n", client.Exchange)
+		log.Printf("Creating %s exchange: %s\n", client.ExchangeKind, client.Exchange)
 		err := client.Channel.ExchangeDeclare(
 			client.Exchange,
-			"direct",
+			string(client.ExchangeKind),
 			true,
 			false,
 			false,
@@ -89,7 +134,11 @@ func (client *RabbitMQClient) createExchange() error {
 	return nil
 }
 
-// createQueue - створює чергу, якщо це необхідно
+// createQueue - створює чергу, якщо це необхідно. Основна черга не несе
+// власних x-dead-letter-* аргументів: маршрутизацію в retry-ланцюг веде
+// виключно routeToRetry (див. WithDeadLetter), тож Nack/Reject поза цим
+// шляхом (наприклад Delivery.Reject або десеріалізація, що не вдалась)
+// призводять до звичайного відхилення брокером, а не до нескінченного retry
 func (client *RabbitMQClient) createQueue() error {
 	if client.Queue != "" {
 		log.Printf("Creating queue: %s\n", client.Queue)
@@ -108,33 +157,54 @@ func (client *RabbitMQClient) createQueue() error {
 	return nil
 }
 
-// bindQueueToExchange - прив'язує чергу до exchange з вказаним роутінг ключем
-func (client *RabbitMQClient) BindQueueToExchange(routingKey string) error {
-	log.Printf("Binding queue %s to exchange %s with routing key %s\n", client.Queue, client.Exchange, routingKey)
+// addBinding - додає прив'язку до client.Bindings, щоб вона автоматично
+// перестворювалась у dialSession при кожному наступному перепідключенні.
+// На поточному каналі прив'язку не застосовує: це робить викликач
+// (наприклад через BindQueueToExchange)
+func (client *RabbitMQClient) addBinding(binding Binding) {
+	client.mu.Lock()
+	client.Bindings = append(client.Bindings, binding)
+	client.mu.Unlock()
+}
+
+// bindQueue - прив'язує чергу до exchange згідно з переданою прив'язкою
+func (client *RabbitMQClient) bindQueue(binding Binding) error {
+	if client.ExchangeKind == ExchangeHeaders {
+		return client.BindQueueToExchange("", binding.Arguments)
+	}
+	return client.BindQueueToExchange(binding.RoutingKey, nil)
+}
+
+// BindQueueToExchange - прив'язує чергу до exchange з вказаним роутінг ключем
+// або, для exchange типу headers, з таблицею аргументів для порівняння заголовків
+func (client *RabbitMQClient) BindQueueToExchange(routingKey string, args amqp.Table) error {
+	log.Printf("Binding queue %s to exchange %s with routing key %q\n", client.Queue, client.Exchange, routingKey)
 	err := client.Channel.QueueBind(
 		client.Queue,
 		routingKey, // використовуємо динамічний роутінг ключ
 		client.Exchange,
 		false,
-		nil)
+		args)
 	if err != nil {
 		log.Printf("Failed to bind queue to exchange: %v\n", err)
 	}
 	return err
 }
 
-// Send - відправляє повідомлення з використанням роутінг ключа
+// Send - відправляє повідомлення з використанням роутінг ключа. Якщо з'єднання
+// саме перепідключається, Send блокується до появи живої сесії або до
+// спрацювання sendTimeout (див. WithSendTimeout)
 func (client *RabbitMQClient) Send(message Message) error {
 	log.Println("Sending message...")
 
-	if client.Connection == nil {
-		log.Println("Connection does not exist.")
-		return errors.New("connection does not exist")
-	}
+	client.mu.RLock()
+	timeout := client.sendTimeout
+	client.mu.RUnlock()
 
-	if client.Channel == nil {
-		log.Println("Channel does not exist.")
-		return errors.New("channel does not exist")
+	session, err := client.sessionBox.get(client.ctx, timeout)
+	if err != nil {
+		log.Printf("No live session available: %v\n", err)
+		return err
 	}
 
 	body, err := client.Serializer.Marshal(message)
@@ -143,17 +213,10 @@ func (client *RabbitMQClient) Send(message Message) error {
 		return err
 	}
 
-	err = client.Channel.Publish(
-		client.Exchange,
-		message.GetRoutingKey(),
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
-
+	err = client.publishOnSession(session, client.Exchange, message.GetRoutingKey(), client.mandatory, amqp.Publishing{
+		ContentType: client.Serializer.ContentType(),
+		Body:        body,
+	}, timeout)
 	if err != nil {
 		log.Printf("Failed to publish message: %v\n", err)
 		return err
@@ -163,29 +226,103 @@ func (client *RabbitMQClient) Send(message Message) error {
 	return nil
 }
 
-// Consume - отримує повідомлення і передає їх в хендлер
+// publishOnSession - публікує msg на каналі сесії session. У reliable-режимі
+// (див. WithReliableMode) серіалізує публікацію під reliableMu і чекає на
+// підтвердження брокера з session.Confirms, перш ніж відпустити наступного
+// publisher'а. session.Confirms - спільний канал з буфером 1, а confirm'и
+// приходять у порядку публікацій без прив'язки до конкретної з них, тож
+// усі публікації на цьому каналі (Send, routeToRetry, RPC) мають йти через
+// цей шлях - інакше вони можуть прочитати чужий confirm або переповнити буфер
+func (client *RabbitMQClient) publishOnSession(session Session, exchange, routingKey string, mandatory bool, msg amqp.Publishing, timeout time.Duration) error {
+	if client.reliable {
+		client.reliableMu.Lock()
+		defer client.reliableMu.Unlock()
+	}
+
+	if err := session.Channel.Publish(exchange, routingKey, mandatory, false, msg); err != nil {
+		return err
+	}
+
+	if client.reliable {
+		return waitForConfirm(session.Confirms, timeout)
+	}
+	return nil
+}
+
+// waitForConfirm - блокується до отримання publisher confirm від брокера
+func waitForConfirm(confirms chan amqp.Confirmation, timeout time.Duration) error {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case confirmation, ok := <-confirms:
+		if !ok || !confirmation.Ack {
+			return errors.New("servicebus: broker did not acknowledge the publish")
+		}
+		return nil
+	case <-timer:
+		return ErrSessionUnavailable
+	}
+}
+
+// Consume - отримує повідомлення і передає їх в хендлер з auto-ack. Реєстрацію
+// запам'ятовується і автоматично відновлюється на кожній новій сесії, тож
+// обробка повідомлень продовжується без повторного виклику Consume
 func (client *RabbitMQClient) Consume(handler func(Message)) error {
+	return client.consume(consumerRegistration{handler: handler})
+}
+
+// ConsumeReliable - те саме, що Consume, але вимагає ввімкненого WithReliableMode:
+// повідомлення забираються з ручним ack, а handler отримує *Delivery для
+// явного Ack()/Nack(requeue)/Reject(). Паніка в handler призводить до Nack(true)
+// замість аварійного завершення горутини консюмера
+func (client *RabbitMQClient) ConsumeReliable(handler func(Message, *Delivery)) error {
+	if !client.reliable {
+		return errors.New("servicebus: ConsumeReliable requires WithReliableMode")
+	}
+	return client.consume(consumerRegistration{reliableHandler: handler})
+}
+
+func (client *RabbitMQClient) consume(reg consumerRegistration) error {
 	log.Println("Starting to consume messages...")
 
-	if client.Connection == nil {
-		log.Println("Connection does not exist.")
-		return errors.New("connection does not exist")
+	session, err := client.sessionBox.get(client.ctx, client.sendTimeout)
+	if err != nil {
+		log.Printf("No live session available: %v\n", err)
+		return err
 	}
 
-	if client.Channel == nil {
-		log.Println("Channel does not exist.")
-		return errors.New("channel does not exist")
+	if err := client.startConsumer(session.Channel, reg); err != nil {
+		return err
 	}
 
-	// Отримання повідомлень з черги
-	messages, err := client.Channel.Consume(
-		client.Queue, // queue name
-		"",           // consumer tag
-		true,         // auto-ack
-		false,        // exclusive
-		false,        // no-local
-		false,        // no-wait
-		nil,          // arguments
+	client.mu.Lock()
+	client.consumers = append(client.consumers, reg)
+	client.mu.Unlock()
+
+	log.Println("Consumer started successfully.")
+	return nil
+}
+
+// startConsumer - оголошує consumer на переданому каналі і запускає горутину
+// обробки повідомлень
+func (client *RabbitMQClient) startConsumer(ch *amqp.Channel, reg consumerRegistration) error {
+	if reg.concurrent != nil {
+		return client.startConcurrentConsumer(ch, reg)
+	}
+
+	autoAck := reg.reliableHandler == nil
+
+	messages, err := ch.Consume(
+		client.Queue,    // queue name
+		reg.consumerTag, // consumer tag
+		autoAck,         // auto-ack
+		false,           // exclusive
+		false,           // no-local
+		false,           // no-wait
+		nil,             // arguments
 	)
 	if err != nil {
 		log.Printf("Failed to start consuming messages: %v\n", err)
@@ -197,32 +334,74 @@ func (client *RabbitMQClient) Consume(handler func(Message)) error {
 		for d := range messages {
 			log.Println("Received a message")
 
+			serializer := client.serializers.resolve(d.ContentType, client.Serializer)
+
 			var msg Message
-			if err := client.Serializer.Unmarshal(d.Body, &msg); err != nil {
+			if err := serializer.Unmarshal(d.Body, &msg); err != nil {
 				log.Printf("Failed to deserialize message: %v\n", err)
+				if !autoAck {
+					// requeue=false без dead-letter на основній черзі - брокер
+					// остаточно відхиляє повідомлення, що не піддається
+					// десеріалізації, замість того щоб зациклити його через retry
+					d.Nack(false, false)
+				}
 				continue
 			}
 
-			handler(msg)
+			client.dispatch(reg, msg, d)
 		}
 	}()
 
-	log.Println("Consumer started successfully.")
 	return nil
 }
 
-// Close - закриває канал і з'єднання
+// dispatch - викликає handler, перетворюючи паніку в Nack(requeue=true)
+// замість краху консюмерної горутини
+func (client *RabbitMQClient) dispatch(reg consumerRegistration, msg Message, d amqp.Delivery) {
+	if reg.reliableHandler == nil {
+		reg.handler(msg)
+		return
+	}
+
+	delivery := &Delivery{Delivery: d, client: client}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Consumer handler panicked: %v\n", r)
+			if err := delivery.Nack(true); err != nil {
+				log.Printf("Failed to nack message after panic: %v\n", err)
+			}
+		}
+	}()
+
+	reg.reliableHandler(msg, delivery)
+}
+
+// Close - зупиняє воркер-пули ConsumeConcurrent (не довше їх ShutdownTimeout),
+// зупиняє петлю перепідключення і закриває поточний канал і з'єднання
 func (client *RabbitMQClient) Close() error {
 	log.Println("Closing RabbitMQ connection...")
 
-	if err := client.Channel.Close(); err != nil {
-		log.Printf("Failed to close channel: %v\n", err)
-		return err
+	client.shutdownWorkerPools()
+
+	client.cancel()
+
+	client.mu.RLock()
+	ch, conn := client.Channel, client.Connection
+	client.mu.RUnlock()
+
+	if ch != nil {
+		if err := ch.Close(); err != nil {
+			log.Printf("Failed to close channel: %v\n", err)
+			return err
+		}
 	}
 
-	if err := client.Connection.Close(); err != nil {
-		log.Printf("Failed to close connection: %v\n", err)
-		return err
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			log.Printf("Failed to close connection: %v\n", err)
+			return err
+		}
 	}
 
 	log.Println("RabbitMQ connection closed successfully.")
@@ -0,0 +1,280 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// Session - живе з'єднання та канал AMQP разом з каналом сповіщення про їх закриття.
+// Confirms і Returns заповнені лише коли клієнт працює в reliable-режимі (WithReliableMode)
+type Session struct {
+	Connection  *amqp.Connection
+	Channel     *amqp.Channel
+	NotifyClose chan *amqp.Error
+	Confirms    chan amqp.Confirmation
+	Returns     chan amqp.Return
+}
+
+// consumerRegistration - параметри Consume/ConsumeReliable/ConsumeConcurrent,
+// які потрібно повторно оголосити на новій сесії. Рівно одне з
+// handler/reliableHandler заповнено; concurrent додатково задано для ConsumeConcurrent
+type consumerRegistration struct {
+	consumerTag     string
+	handler         func(Message)
+	reliableHandler func(Message, *Delivery)
+	concurrent      *ConsumerOptions
+}
+
+const (
+	defaultSendTimeout   = 10 * time.Second
+	initialRedialBackoff = 1 * time.Second
+	maxRedialBackoff     = 30 * time.Second
+)
+
+// ErrSessionUnavailable - немає живої сесії протягом відведеного часу очікування.
+// Той самий error повертає publishOnSession у reliable-режимі, якщо publisher
+// confirm не надійшов за відведений час
+var ErrSessionUnavailable = errors.New("servicebus: timed out waiting for a live RabbitMQ session")
+
+// ErrClientClosed - клієнт закрито, операція неможлива. Ним також
+// завершуються виклики RPCClient.Call, що чекали на відповідь, коли базовий
+// клієнт перепідключився
+var ErrClientClosed = errors.New("servicebus: client is closed")
+
+// sessionBox - зберігає останню живу сесію і дозволяє блокуюче очікування її появи
+type sessionBox struct {
+	mu   sync.RWMutex
+	sess Session
+	ok   bool
+	wait chan struct{}
+}
+
+func newSessionBox() *sessionBox {
+	return &sessionBox{wait: make(chan struct{})}
+}
+
+func (b *sessionBox) set(session Session) {
+	b.mu.Lock()
+	b.sess = session
+	b.ok = true
+	close(b.wait)
+	b.wait = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *sessionBox) clear() {
+	b.mu.Lock()
+	b.ok = false
+	b.mu.Unlock()
+}
+
+func (b *sessionBox) get(ctx context.Context, timeout time.Duration) (Session, error) {
+	for {
+		b.mu.RLock()
+		session, ok, wait := b.sess, b.ok, b.wait
+		b.mu.RUnlock()
+
+		if ok {
+			return session, nil
+		}
+
+		var timer <-chan time.Time
+		if timeout > 0 {
+			timer = time.After(timeout)
+		}
+
+		select {
+		case <-wait:
+		case <-timer:
+			return Session{}, ErrSessionUnavailable
+		case <-ctx.Done():
+			return Session{}, ErrClientClosed
+		}
+	}
+}
+
+// WithSendTimeout - задає час, протягом якого Send очікуватиме на живу сесію
+// перед тим, як повернути помилку (за замовчуванням 10s)
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(client *RabbitMQClient) {
+		client.sendTimeout = timeout
+	}
+}
+
+// NotifyReconnect - реєструє канал, у який клієнт надсилає nil після кожного
+// успішного перепідключення і помилку після кожної невдалої спроби.
+// Надсилання неблокуюче: якщо канал не готовий прийняти значення (буфер
+// заповнений і ніхто не читає), подію для цього каналу пропущено
+func (client *RabbitMQClient) NotifyReconnect(ch chan error) chan error {
+	client.mu.Lock()
+	client.reconnectListeners = append(client.reconnectListeners, ch)
+	client.mu.Unlock()
+	return ch
+}
+
+func (client *RabbitMQClient) notifyReconnect(err error) {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	for _, ch := range client.reconnectListeners {
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
+
+// dialSession - встановлює нове з'єднання та канал і відновлює топологію (exchange/queue/bindings)
+func (client *RabbitMQClient) dialSession(amqpURL string) (Session, error) {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return Session{}, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return Session{}, err
+	}
+
+	client.mu.Lock()
+	client.Connection = conn
+	client.Channel = ch
+	client.mu.Unlock()
+
+	if err := client.createExchange(); err != nil {
+		ch.Close()
+		conn.Close()
+		return Session{}, err
+	}
+	if err := client.createQueue(); err != nil {
+		ch.Close()
+		conn.Close()
+		return Session{}, err
+	}
+	client.mu.RLock()
+	bindings := make([]Binding, len(client.Bindings))
+	copy(bindings, client.Bindings)
+	client.mu.RUnlock()
+
+	for _, binding := range bindings {
+		if err := client.bindQueue(binding); err != nil {
+			ch.Close()
+			conn.Close()
+			return Session{}, err
+		}
+	}
+
+	if err := client.setupDeadLetter(ch); err != nil {
+		ch.Close()
+		conn.Close()
+		return Session{}, err
+	}
+
+	session := Session{Connection: conn, Channel: ch}
+
+	if err := client.setupReliability(ch, &session); err != nil {
+		ch.Close()
+		conn.Close()
+		return Session{}, err
+	}
+
+	// conn і ch кожен мають власний канал сповіщення: amqp закриває/пише в
+	// них незалежно одне від одного під час каскадного shutdown з'єднання,
+	// тож спільний канал на двох NotifyClose призводить до send/close на вже
+	// закритому каналі. Зводимо обидва в один notifyClose для startRedial
+	connClose := make(chan *amqp.Error, 1)
+	chClose := make(chan *amqp.Error, 1)
+	conn.NotifyClose(connClose)
+	ch.NotifyClose(chClose)
+
+	notifyClose := make(chan *amqp.Error, 1)
+	go func() {
+		select {
+		case err := <-connClose:
+			notifyClose <- err
+		case err := <-chClose:
+			notifyClose <- err
+		}
+	}()
+	session.NotifyClose = notifyClose
+
+	return session, nil
+}
+
+// startRedial - бере вже встановлену сесію під свою опіку і перепідключається
+// з експоненційною паузою щоразу, коли вона закривається, доки не спрацює ctx
+func (client *RabbitMQClient) startRedial(ctx context.Context, amqpURL string, first Session) {
+	client.sessionBox.set(first)
+
+	go func() {
+		session := first
+		backoff := initialRedialBackoff
+
+		for {
+			select {
+			case <-session.NotifyClose:
+				log.Println("RabbitMQ session closed, reconnecting...")
+			case <-ctx.Done():
+				session.Connection.Close()
+				return
+			}
+
+			client.sessionBox.clear()
+
+			var err error
+			for {
+				session, err = client.dialSession(amqpURL)
+				if err == nil {
+					break
+				}
+
+				client.notifyReconnect(err)
+				log.Printf("Failed to reconnect to RabbitMQ: %v, retrying in %s\n", err, backoff)
+
+				select {
+				case <-time.After(backoff):
+					backoff = nextBackoff(backoff)
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			backoff = initialRedialBackoff
+			client.sessionBox.set(session)
+
+			if err := client.resumeConsumers(session); err != nil {
+				log.Printf("Failed to resume consumers after reconnect: %v\n", err)
+			}
+
+			client.notifyReconnect(nil)
+		}
+	}()
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > maxRedialBackoff {
+		return maxRedialBackoff
+	}
+	return next
+}
+
+// resumeConsumers - повторно оголошує consumer'и, зареєстровані до перепідключення,
+// на каналі нової сесії
+func (client *RabbitMQClient) resumeConsumers(session Session) error {
+	client.mu.RLock()
+	registrations := make([]consumerRegistration, len(client.consumers))
+	copy(registrations, client.consumers)
+	client.mu.RUnlock()
+
+	for _, reg := range registrations {
+		if err := client.startConsumer(session.Channel, reg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package servicebus
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"log"
+	"strings"
+	"time"
+)
+
+// Delivery - обгортка над amqp.Delivery для консюмерів у reliable-режимі, що
+// вимагає явного підтвердження обробки замість auto-ack
+type Delivery struct {
+	amqp.Delivery
+	client *RabbitMQClient
+}
+
+// Ack - підтверджує успішну обробку повідомлення
+func (d *Delivery) Ack() error {
+	return d.Delivery.Ack(false)
+}
+
+// Nack - відхиляє повідомлення. Якщо для черги налаштовано dead-letter
+// (WithDeadLetter), requeue=false спрямовує повідомлення у наступний рівень
+// retry-черги замість негайного відхилення, доки не буде вичерпано MaxAttempts
+func (d *Delivery) Nack(requeue bool) error {
+	if requeue || d.client.deadLetter == nil {
+		return d.Delivery.Nack(false, requeue)
+	}
+	return d.client.routeToRetry(d.Delivery)
+}
+
+// Reject - відхиляє повідомлення без можливості повторної доставки через
+// retry-ланцюг; еквівалент Nack(false) без dead-letter обробки
+func (d *Delivery) Reject() error {
+	return d.Delivery.Reject(false)
+}
+
+// DeadLetterConfig - конфігурація dead-letter exchange та ланцюга retry-черг
+// із зростаючим TTL, застосована через WithDeadLetter
+type DeadLetterConfig struct {
+	Exchange    string
+	RetryDelays []time.Duration
+	MaxAttempts int
+}
+
+// WithReliableMode - вмикає publisher confirms та ручний ack з вказаним
+// prefetch замість auto-ack. Send чекатиме на підтвердження брокера, а
+// ConsumeReliable передаватиме handler'у *Delivery для явного Ack/Nack/Reject
+// (звичайний Consume і далі працює з auto-ack)
+func WithReliableMode(prefetch int) Option {
+	return func(client *RabbitMQClient) {
+		client.reliable = true
+		client.prefetch = prefetch
+	}
+}
+
+// WithMandatoryPublish - вмикає mandatory-публікацію: повідомлення, які
+// брокер не може маршрутизувати до жодної черги, повертаються в onReturn
+// замість того, щоб мовчки загубитися. onReturn підключається лише разом з
+// WithReliableMode: без нього публікації йдуть з mandatory, але повернення
+// брокера до onReturn не доходять
+func WithMandatoryPublish(onReturn func(amqp.Return)) Option {
+	return func(client *RabbitMQClient) {
+		client.mandatory = true
+		client.onReturn = onReturn
+	}
+}
+
+// WithDeadLetter - додає dead-letter exchange та ланцюг retry-черг з рівнями
+// затримок retryDelays (наприклад 5s/30s/5m); maxAttempts обмежує кількість
+// повторів, які читаються з лічильника x-death заголовка
+func WithDeadLetter(exchange string, maxAttempts int, retryDelays ...time.Duration) Option {
+	return func(client *RabbitMQClient) {
+		client.deadLetter = &DeadLetterConfig{
+			Exchange:    exchange,
+			RetryDelays: retryDelays,
+			MaxAttempts: maxAttempts,
+		}
+	}
+}
+
+// setupReliability - переводить канал у режим publisher confirms/mandatory
+// returns/QoS відповідно до налаштованих опцій і заповнює відповідні поля сесії
+func (client *RabbitMQClient) setupReliability(ch *amqp.Channel, session *Session) error {
+	if !client.reliable {
+		return nil
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		log.Printf("Failed to put channel into confirm mode: %v\n", err)
+		return err
+	}
+	session.Confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	if err := ch.Qos(client.prefetch, 0, false); err != nil {
+		log.Printf("Failed to set QoS: %v\n", err)
+		return err
+	}
+
+	if client.mandatory {
+		session.Returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+		if client.onReturn != nil {
+			go func(returns chan amqp.Return) {
+				for ret := range returns {
+					client.onReturn(ret)
+				}
+			}(session.Returns)
+		}
+	}
+
+	return nil
+}
+
+// retryRoutingKey - роутінг ключ, яким retry-черга рівня level прив'язана до DLX
+func retryRoutingKey(level int) string {
+	return fmt.Sprintf("retry-%d", level)
+}
+
+// setupDeadLetter - оголошує dead-letter exchange і ланцюг retry-черг з TTL,
+// кожна з яких після спрацювання TTL повертає повідомлення назад у основну чергу
+func (client *RabbitMQClient) setupDeadLetter(ch *amqp.Channel) error {
+	dlx := client.deadLetter
+	if dlx == nil || dlx.Exchange == "" {
+		return nil
+	}
+
+	if err := ch.ExchangeDeclare(dlx.Exchange, string(ExchangeDirect), true, false, false, false, nil); err != nil {
+		log.Printf("Failed to declare dead-letter exchange: %v\n", err)
+		return err
+	}
+
+	for level, delay := range dlx.RetryDelays {
+		retryQueue := client.retryQueueName(level)
+		_, err := ch.QueueDeclare(retryQueue, true, false, false, false, amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": client.Queue,
+		})
+		if err != nil {
+			log.Printf("Failed to declare retry queue %s: %v\n", retryQueue, err)
+			return err
+		}
+
+		if err := ch.QueueBind(retryQueue, retryRoutingKey(level), dlx.Exchange, false, nil); err != nil {
+			log.Printf("Failed to bind retry queue %s: %v\n", retryQueue, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retryQueueName - назва retry-черги для рівня level
+func (client *RabbitMQClient) retryQueueName(level int) string {
+	return fmt.Sprintf("%s.retry.%d", client.Queue, level)
+}
+
+// retryQueuePrefix - спільний префікс назв усіх retry-черг клієнта, за яким
+// deathCount відрізняє "смерті" у retry-ланцюгу від смертей основної черги
+func (client *RabbitMQClient) retryQueuePrefix() string {
+	return client.Queue + ".retry."
+}
+
+// routeToRetry - визначає кількість попередніх спроб з x-death заголовка і
+// republish'ить повідомлення у відповідний рівень retry-черги, або остаточно
+// підтверджує (Ack) повідомлення, якщо MaxAttempts вичерпано
+func (client *RabbitMQClient) routeToRetry(d amqp.Delivery) error {
+	attempts := deathCount(d, client.retryQueuePrefix())
+
+	if attempts >= client.deadLetter.MaxAttempts {
+		log.Printf("Message exceeded max retry attempts (%d), dropping\n", client.deadLetter.MaxAttempts)
+		return d.Ack(false)
+	}
+
+	level := attempts
+	if level >= len(client.deadLetter.RetryDelays) {
+		level = len(client.deadLetter.RetryDelays) - 1
+	}
+
+	session, err := client.sessionBox.get(client.ctx, client.sendTimeout)
+	if err != nil {
+		return d.Nack(false, true)
+	}
+
+	err = client.publishOnSession(session, client.deadLetter.Exchange, retryRoutingKey(level), false, amqp.Publishing{
+		ContentType: d.ContentType,
+		Body:        d.Body,
+		Headers:     d.Headers,
+	}, client.sendTimeout)
+	if err != nil {
+		log.Printf("Failed to route message to retry queue: %v\n", err)
+		return d.Nack(false, true)
+	}
+
+	return d.Ack(false)
+}
+
+// deathCount - сумарна кількість спроб доставки повідомлення через
+// retry-ланцюг, прочитана з заголовка x-death (додається брокером при
+// кожному dead-letter). routeToRetry сам Ack'ає доставку з основної черги й
+// republish'ить у DLX, тож брокер ніколи не дед-летерить саму основну чергу
+// - єдині записи x-death належать чергам retryPrefix+"<n>", тож рахуємо
+// count по всіх з них, а не лише по одній назві черги
+func deathCount(d amqp.Delivery, retryPrefix string) int {
+	raw, ok := d.Headers["x-death"]
+	if !ok {
+		return 0
+	}
+
+	deaths, ok := raw.([]interface{})
+	if !ok {
+		return 0
+	}
+
+	total := 0
+	for _, entry := range deaths {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		q, _ := table["queue"].(string)
+		if !strings.HasPrefix(q, retryPrefix) {
+			continue
+		}
+		switch count := table["count"].(type) {
+		case int64:
+			total += int(count)
+		case int32:
+			total += int(count)
+		}
+	}
+	return total
+}
@@ -0,0 +1,287 @@
+package servicebus
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+)
+
+// rpcResult - відповідь на RPC-виклик або помилка, якщо сесія обірвалась
+// раніше, ніж прийшла відповідь
+type rpcResult struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// RPCClient - клієнт запит/відповідь поверх RabbitMQClient: публікує запит з
+// ReplyTo та CorrelationId і зіставляє відповідь з відповідним викликом Call
+type RPCClient struct {
+	client *RabbitMQClient
+
+	mu         sync.Mutex
+	replyQueue string
+	pending    map[string]chan rpcResult
+
+	reconnect chan error
+}
+
+// NewRPCClient - оголошує ексклюзивну auto-delete чергу для відповідей і
+// запускає прослуховування; черга і consumer перестворюються при кожному
+// перепідключенні базового клієнта
+func NewRPCClient(client *RabbitMQClient) (*RPCClient, error) {
+	rpc := &RPCClient{
+		client:    client,
+		pending:   make(map[string]chan rpcResult),
+		reconnect: make(chan error, 1),
+	}
+
+	if err := rpc.listen(); err != nil {
+		return nil, err
+	}
+
+	client.NotifyReconnect(rpc.reconnect)
+	go rpc.watchReconnects()
+
+	return rpc, nil
+}
+
+// Call - публікує req на routingKey, чекає на відповідь з тим самим
+// CorrelationId і декодує її в resp. Повертається за скасуванням/дедлайном ctx.
+// Якщо базовий клієнт у reliable-режимі, публікація йде через
+// publishOnSession і Call додатково чекає на підтвердження брокером самої
+// публікації запиту, перш ніж очікувати відповідь.
+//
+// RPCServer не публікує error-відповідь, коли handler повертає помилку
+// (див. Handle) - такий запит просто не отримає відповіді, тож без
+// дедлайну/таймауту на ctx Call повертається лише тоді, коли закриється
+// базовий клієнт або коли після його перепідключення watchReconnects
+// завершить очікуючі виклики помилкою ErrClientClosed
+func (rpc *RPCClient) Call(ctx context.Context, routingKey string, req, resp interface{}) error {
+	body, err := rpc.client.Serializer.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	correlationID := uuid.NewString()
+	result := make(chan rpcResult, 1)
+
+	rpc.mu.Lock()
+	rpc.pending[correlationID] = result
+	replyTo := rpc.replyQueue
+	rpc.mu.Unlock()
+
+	defer func() {
+		rpc.mu.Lock()
+		delete(rpc.pending, correlationID)
+		rpc.mu.Unlock()
+	}()
+
+	session, err := rpc.client.sessionBox.get(rpc.client.ctx, rpc.client.sendTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = rpc.client.publishOnSession(session, rpc.client.Exchange, routingKey, false, amqp.Publishing{
+		ContentType:   rpc.client.Serializer.ContentType(),
+		CorrelationId: correlationID,
+		ReplyTo:       replyTo,
+		Body:          body,
+	}, rpc.client.sendTimeout)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case res := <-result:
+		if res.err != nil {
+			return res.err
+		}
+		return rpc.client.Serializer.Unmarshal(res.delivery.Body, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rpc.client.ctx.Done():
+		return ErrClientClosed
+	}
+}
+
+// listen - (пере)оголошує ексклюзивну чергу відповідей і запускає consumer,
+// що розподіляє доставки в очікуючі виклики за CorrelationId
+func (rpc *RPCClient) listen() error {
+	session, err := rpc.client.sessionBox.get(rpc.client.ctx, rpc.client.sendTimeout)
+	if err != nil {
+		return err
+	}
+
+	q, err := session.Channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		log.Printf("Failed to declare RPC reply queue: %v\n", err)
+		return err
+	}
+
+	messages, err := session.Channel.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		log.Printf("Failed to consume RPC reply queue: %v\n", err)
+		return err
+	}
+
+	rpc.mu.Lock()
+	rpc.replyQueue = q.Name
+	rpc.mu.Unlock()
+
+	go func() {
+		for d := range messages {
+			rpc.mu.Lock()
+			result, ok := rpc.pending[d.CorrelationId]
+			rpc.mu.Unlock()
+			if !ok {
+				continue
+			}
+			result <- rpcResult{delivery: d}
+		}
+	}()
+
+	return nil
+}
+
+// watchReconnects - після кожного успішного перепідключення завершує виклики,
+// що чекають на відповідь, помилкою ErrClientClosed і перестворює чергу
+// відповідей на новій сесії. Сама втрата сесії і невдалі спроби
+// перепідключення очікуючих викликів не завершують: до успішного
+// перепідключення вони чекають далі (або до скасування свого ctx)
+func (rpc *RPCClient) watchReconnects() {
+	for err := range rpc.reconnect {
+		if err != nil {
+			continue
+		}
+
+		rpc.failPending(ErrClientClosed)
+
+		if err := rpc.listen(); err != nil {
+			log.Printf("Failed to re-establish RPC reply queue after reconnect: %v\n", err)
+		}
+	}
+}
+
+// failPending - завершує всі виклики, що очікують на відповідь, помилкою err
+func (rpc *RPCClient) failPending(err error) {
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	for id, result := range rpc.pending {
+		select {
+		case result <- rpcResult{err: err}:
+		default:
+		}
+		delete(rpc.pending, id)
+	}
+}
+
+// RPCServer - обробляє RPC-запити, надіслані через RPCClient.Call, і
+// публікує відповідь у ReplyTo з тим самим CorrelationId
+type RPCServer struct {
+	client *RabbitMQClient
+
+	mu       sync.Mutex
+	handlers map[string]func(Message) (Message, error)
+	started  bool
+}
+
+// NewRPCServer - створює сервер, що прийматиме запити на черзі клієнта client
+func NewRPCServer(client *RabbitMQClient) *RPCServer {
+	return &RPCServer{
+		client:   client,
+		handlers: make(map[string]func(Message) (Message, error)),
+	}
+}
+
+// Handle - прив'язує чергу до routingKey і реєструє handler для нього.
+// Consumer запускається лише один раз і далі мультиплексує запити за
+// routing key доставки, тож кілька Handle можуть ділити одну чергу.
+// Прив'язка також запам'ятовується в client.Bindings, тож dialSession
+// відновлює її на новому каналі після будь-якого перепідключення.
+//
+// Якщо handler повертає помилку (або публікація відповіді не вдалась),
+// запит лише Nack'ається - серверна сторона не публікує окрему
+// error-відповідь. Це означає, що відповідний Call мовчки чекає, доки не
+// спрацює його ctx, і з WithDeadLetter також: retry-копія запиту, яку
+// публікує routeToRetry, не несе ReplyTo і CorrelationId. Тож
+// викликачі мають завжди обмежувати Call дедлайном/таймаутом
+func (server *RPCServer) Handle(routingKey string, handler func(Message) (Message, error)) error {
+	if err := server.client.BindQueueToExchange(routingKey, nil); err != nil {
+		return err
+	}
+	server.client.addBinding(Binding{RoutingKey: routingKey})
+
+	server.mu.Lock()
+	server.handlers[routingKey] = handler
+	alreadyStarted := server.started
+	server.started = true
+	server.mu.Unlock()
+
+	if alreadyStarted {
+		return nil
+	}
+
+	return server.client.consume(consumerRegistration{reliableHandler: server.dispatch})
+}
+
+func (server *RPCServer) dispatch(req Message, d *Delivery) {
+	server.mu.Lock()
+	handler, ok := server.handlers[d.RoutingKey]
+	server.mu.Unlock()
+
+	if !ok {
+		log.Printf("No RPC handler registered for routing key %s\n", d.RoutingKey)
+		if err := d.Reject(); err != nil {
+			log.Printf("Failed to reject RPC request: %v\n", err)
+		}
+		return
+	}
+
+	resp, err := handler(req)
+	if err != nil {
+		log.Printf("RPC handler for %s failed: %v\n", d.RoutingKey, err)
+		if err := d.Nack(false); err != nil {
+			log.Printf("Failed to nack RPC request: %v\n", err)
+		}
+		return
+	}
+
+	if err := server.reply(d.Delivery, resp); err != nil {
+		log.Printf("Failed to publish RPC reply: %v\n", err)
+		if err := d.Nack(false); err != nil {
+			log.Printf("Failed to nack RPC request: %v\n", err)
+		}
+		return
+	}
+
+	if err := d.Ack(); err != nil {
+		log.Printf("Failed to ack RPC request: %v\n", err)
+	}
+}
+
+// reply - публікує resp у d.ReplyTo через default exchange з тим самим
+// CorrelationId, яким був позначений запит
+func (server *RPCServer) reply(d amqp.Delivery, resp Message) error {
+	if d.ReplyTo == "" {
+		return nil
+	}
+
+	body, err := server.client.Serializer.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	session, err := server.client.sessionBox.get(server.client.ctx, server.client.sendTimeout)
+	if err != nil {
+		return err
+	}
+
+	return server.client.publishOnSession(session, "", d.ReplyTo, false, amqp.Publishing{
+		ContentType:   server.client.Serializer.ContentType(),
+		CorrelationId: d.CorrelationId,
+		Body:          body,
+	}, server.client.sendTimeout)
+}
@@ -0,0 +1,114 @@
+package servicebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Serializer - кодує/декодує тіло AMQP-повідомлення та повідомляє свій
+// Content-Type для заголовка публікації і диспетчеризації на стороні consume
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	ContentType() string
+}
+
+// JSONSerializer - серіалізатор на основі encoding/json
+type JSONSerializer struct{}
+
+func (s *JSONSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (s *JSONSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (s *JSONSerializer) ContentType() string {
+	return "application/json"
+}
+
+// ProtobufSerializer - серіалізатор на основі protobuf; значення, що
+// передаються в Marshal/Unmarshal, мають реалізовувати proto.Message
+type ProtobufSerializer struct{}
+
+func (s *ProtobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("servicebus: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (s *ProtobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("servicebus: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (s *ProtobufSerializer) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// MsgpackSerializer - серіалізатор на основі MessagePack
+type MsgpackSerializer struct{}
+
+func (s *MsgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (s *MsgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (s *MsgpackSerializer) ContentType() string {
+	return "application/msgpack"
+}
+
+// serializerRegistry - реєстр серіалізаторів за їх Content-Type, що дозволяє
+// consume-стороні декодувати повідомлення різних форматів з однієї черги
+type serializerRegistry map[string]Serializer
+
+func newSerializerRegistry(serializers ...Serializer) serializerRegistry {
+	registry := make(serializerRegistry, len(serializers))
+	for _, s := range serializers {
+		registry[s.ContentType()] = s
+	}
+	return registry
+}
+
+// resolve - повертає серіалізатор, зареєстрований для contentType, або
+// fallback, якщо такого немає чи заголовок порожній
+func (r serializerRegistry) resolve(contentType string, fallback Serializer) Serializer {
+	if contentType != "" {
+		if s, ok := r[contentType]; ok {
+			return s
+		}
+	}
+	return fallback
+}
+
+// WithSerializer - задає серіалізатор за замовчуванням, який Send
+// використовує для нових повідомлень, і реєструє його для розпізнавання
+// відповідного Content-Type під час consume
+func WithSerializer(serializer Serializer) Option {
+	return func(client *RabbitMQClient) {
+		client.Serializer = serializer
+		client.serializers[serializer.ContentType()] = serializer
+	}
+}
+
+// WithSerializers - додатково реєструє серіалізатори для декодування вхідних
+// повідомлень за їх Content-Type, не змінюючи серіалізатор за замовчуванням.
+// Використовується, коли одна черга тимчасово несе кілька форматів під час міграції
+func WithSerializers(serializers ...Serializer) Option {
+	return func(client *RabbitMQClient) {
+		for _, s := range serializers {
+			client.serializers[s.ContentType()] = s
+		}
+	}
+}
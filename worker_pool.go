@@ -0,0 +1,168 @@
+package servicebus
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// ConsumerOptions - параметри пулу воркерів для ConsumeConcurrent
+type ConsumerOptions struct {
+	Workers         int
+	Prefetch        int
+	ShutdownTimeout time.Duration
+}
+
+// workerPool - облік запущеного пулу воркерів, потрібний для graceful shutdown у Close
+type workerPool struct {
+	channel         *amqp.Channel
+	consumerTag     string
+	wg              *sync.WaitGroup
+	shutdownTimeout time.Duration
+}
+
+// ConsumeConcurrent - розподіляє доставки з черги по opts.Workers воркерах
+// замість послідовної обробки в одній горутині, даючи ефект конкурентних
+// споживачів ("work queue") без ручного керування горутинами і QoS. Consumer
+// перестворюється при перепідключенні так само, як звичайний Consume
+func (client *RabbitMQClient) ConsumeConcurrent(handler func(Message), opts ConsumerOptions) error {
+	reg := consumerRegistration{
+		consumerTag: fmt.Sprintf("%s-pool-%s", client.Queue, uuid.NewString()),
+		handler:     handler,
+		concurrent:  &opts,
+	}
+
+	return client.consume(reg)
+}
+
+// startConcurrentConsumer - оголошує consumer з ручним ack і заданим Qos та
+// фанаутить доставки на opts.Workers воркерів через буферизований канал
+func (client *RabbitMQClient) startConcurrentConsumer(ch *amqp.Channel, reg consumerRegistration) error {
+	opts := reg.concurrent
+
+	if err := ch.Qos(opts.Prefetch, 0, false); err != nil {
+		log.Printf("Failed to set QoS: %v\n", err)
+		return err
+	}
+
+	messages, err := ch.Consume(
+		client.Queue,
+		reg.consumerTag,
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		log.Printf("Failed to start consuming messages: %v\n", err)
+		return err
+	}
+
+	jobs := make(chan amqp.Delivery, opts.Workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go client.consumeWorker(jobs, reg, &wg)
+	}
+
+	go func() {
+		defer close(jobs)
+		for d := range messages {
+			jobs <- d
+		}
+	}()
+
+	client.mu.Lock()
+	client.workerPools = append(client.pruneWorkerPools(reg.consumerTag), &workerPool{
+		channel:         ch,
+		consumerTag:     reg.consumerTag,
+		wg:              &wg,
+		shutdownTimeout: opts.ShutdownTimeout,
+	})
+	client.mu.Unlock()
+
+	return nil
+}
+
+// pruneWorkerPools - видаляє з обліку попередній пул того самого
+// consumerTag (лишається від сесії, яка вже закрилась при перепідключенні).
+// Викликається під client.mu
+func (client *RabbitMQClient) pruneWorkerPools(consumerTag string) []*workerPool {
+	kept := client.workerPools[:0]
+	for _, pool := range client.workerPools {
+		if pool.consumerTag != consumerTag {
+			kept = append(kept, pool)
+		}
+	}
+	return kept
+}
+
+// consumeWorker - обробляє доставки з jobs, підтверджуючи їх після успішного
+// виклику handler; паніка в handler призводить до Nack(requeue=true)
+func (client *RabbitMQClient) consumeWorker(jobs chan amqp.Delivery, reg consumerRegistration, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for d := range jobs {
+		serializer := client.serializers.resolve(d.ContentType, client.Serializer)
+
+		var msg Message
+		if err := serializer.Unmarshal(d.Body, &msg); err != nil {
+			log.Printf("Failed to deserialize message: %v\n", err)
+			d.Nack(false, false)
+			continue
+		}
+
+		client.dispatchConcurrent(reg, msg, d)
+	}
+}
+
+// dispatchConcurrent - викликає handler і підтверджує доставку, перетворюючи
+// паніку в Nack(requeue=true) замість краху воркера
+func (client *RabbitMQClient) dispatchConcurrent(reg consumerRegistration, msg Message, d amqp.Delivery) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Consumer handler panicked: %v\n", r)
+			if err := d.Nack(false, true); err != nil {
+				log.Printf("Failed to nack message after panic: %v\n", err)
+			}
+		}
+	}()
+
+	reg.handler(msg)
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("Failed to ack message: %v\n", err)
+	}
+}
+
+// shutdownWorkerPools - зупиняє consumer кожного пулу і чекає завершення його
+// воркерів не довше заданого ShutdownTimeout
+func (client *RabbitMQClient) shutdownWorkerPools() {
+	client.mu.Lock()
+	pools := client.workerPools
+	client.workerPools = nil
+	client.mu.Unlock()
+
+	for _, pool := range pools {
+		if err := pool.channel.Cancel(pool.consumerTag, false); err != nil {
+			log.Printf("Failed to cancel consumer %s: %v\n", pool.consumerTag, err)
+		}
+
+		done := make(chan struct{})
+		go func(wg *sync.WaitGroup) {
+			wg.Wait()
+			close(done)
+		}(pool.wg)
+
+		select {
+		case <-done:
+		case <-time.After(pool.shutdownTimeout):
+			log.Printf("Timed out waiting for consumer %s workers to finish\n", pool.consumerTag)
+		}
+	}
+}